@@ -0,0 +1,361 @@
+package cmgs3
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+func init() {
+	caddy.RegisterModule(CaddyStorage{})
+}
+
+// CaddyStorage is a Caddy storage module wrapping S3Storage, registered as
+// `caddy.storage.s3` so it can be configured via Caddyfile (`storage s3 {
+// ... }`) or the JSON admin API (`storage: {"module": "s3", ...}`). The
+// endpoint, bucket, access key, secret key, object prefix and encryption key
+// fields are expanded in Provision, so they can carry Caddy
+// environment-variable placeholders such as `{env.S3_SECRET_ACCESS_KEY}`.
+type CaddyStorage struct {
+	Endpoint        string `json:"endpoint,omitempty"`
+	Bucket          string `json:"bucket,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	ObjPrefix       string `json:"obj_prefix,omitempty"`
+	Insecure        bool   `json:"insecure,omitempty"`
+
+	// EncryptionKey is a base64-encoded 32-byte key for client-side NaCl
+	// SecretBox encryption. Leave empty to store certificates in clear text.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+
+	// ServerSideEncryption selects S3 server-side encryption: "s3" (SSE-S3),
+	// "kms" (SSE-KMS, using SSEKMSKeyID) or "c" (SSE-C, using SSECKey, a
+	// base64-encoded 32-byte key). Leave empty to disable it.
+	ServerSideEncryption string `json:"server_side_encryption,omitempty"`
+	SSEKMSKeyID          string `json:"sse_kms_key_id,omitempty"`
+	SSECKey              string `json:"sse_c_key,omitempty"`
+
+	CredentialProvider       CredentialProvider   `json:"credential_provider,omitempty"`
+	IAMEndpoint              string               `json:"iam_endpoint,omitempty"`
+	STSAssumeRole            STSAssumeRoleOpts    `json:"sts_assume_role,omitempty"`
+	CredentialsFile          CredentialsFileOpts  `json:"credentials_file,omitempty"`
+	CredentialChainProviders []CredentialProvider `json:"credential_chain,omitempty"`
+	WebIdentity              WebIdentityOpts      `json:"web_identity,omitempty"`
+
+	DisableAtomicLock bool          `json:"disable_atomic_lock,omitempty"`
+	ManageLifecycle   bool          `json:"manage_lifecycle,omitempty"`
+	LockTTL           time.Duration `json:"lock_ttl,omitempty"`
+
+	storage *S3Storage
+}
+
+var (
+	_ caddy.Module           = (*CaddyStorage)(nil)
+	_ caddy.Provisioner      = (*CaddyStorage)(nil)
+	_ caddy.StorageConverter = (*CaddyStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*CaddyStorage)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (CaddyStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.s3",
+		New: func() caddy.Module { return new(CaddyStorage) },
+	}
+}
+
+// Provision sets up the module, expanding environment placeholders and
+// constructing the underlying S3Storage.
+func (cs *CaddyStorage) Provision(ctx caddy.Context) error {
+	repl := caddy.NewReplacer()
+	cs.Endpoint = repl.ReplaceAll(cs.Endpoint, "")
+	cs.Bucket = repl.ReplaceAll(cs.Bucket, "")
+	cs.AccessKeyID = repl.ReplaceAll(cs.AccessKeyID, "")
+	cs.SecretAccessKey = repl.ReplaceAll(cs.SecretAccessKey, "")
+	cs.ObjPrefix = repl.ReplaceAll(cs.ObjPrefix, "")
+	cs.EncryptionKey = repl.ReplaceAll(cs.EncryptionKey, "")
+	cs.SSEKMSKeyID = repl.ReplaceAll(cs.SSEKMSKeyID, "")
+	cs.SSECKey = repl.ReplaceAll(cs.SSECKey, "")
+
+	if cs.Endpoint == "" {
+		return fmt.Errorf("s3 storage: endpoint is required")
+	}
+	if cs.Bucket == "" {
+		return fmt.Errorf("s3 storage: bucket is required")
+	}
+
+	opts := S3Opts{
+		Endpoint:                 cs.Endpoint,
+		Bucket:                   cs.Bucket,
+		AccessKeyID:              cs.AccessKeyID,
+		SecretAccessKey:          cs.SecretAccessKey,
+		ObjPrefix:                cs.ObjPrefix,
+		Insecure:                 cs.Insecure,
+		CredentialProvider:       cs.CredentialProvider,
+		IAMEndpoint:              cs.IAMEndpoint,
+		STSAssumeRole:            cs.STSAssumeRole,
+		CredentialsFile:          cs.CredentialsFile,
+		CredentialChainProviders: cs.CredentialChainProviders,
+		WebIdentity:              cs.WebIdentity,
+		DisableAtomicLock:        cs.DisableAtomicLock,
+		ManageLifecycle:          cs.ManageLifecycle,
+		LockTTL:                  cs.LockTTL,
+	}
+
+	if cs.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cs.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("s3 storage: decoding encryption_key: %w", err)
+		}
+		opts.EncryptionKey = key
+	}
+
+	sse, err := cs.serverSideEncryption()
+	if err != nil {
+		return err
+	}
+	opts.ServerSideEncryption = sse
+
+	storage, err := NewS3Storage(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("s3 storage: %w", err)
+	}
+	cs.storage = storage
+
+	return nil
+}
+
+func (cs *CaddyStorage) serverSideEncryption() (encrypt.ServerSide, error) {
+	switch cs.ServerSideEncryption {
+	case "":
+		return nil, nil
+	case "s3":
+		return encrypt.NewSSE(), nil
+	case "kms":
+		return encrypt.NewSSEKMS(cs.SSEKMSKeyID, nil)
+	case "c":
+		key, err := base64.StdEncoding.DecodeString(cs.SSECKey)
+		if err != nil {
+			return nil, fmt.Errorf("s3 storage: decoding sse_c_key: %w", err)
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("s3 storage: unknown server_side_encryption %q", cs.ServerSideEncryption)
+	}
+}
+
+// CertMagicStorage implements caddy.StorageConverter.
+func (cs *CaddyStorage) CertMagicStorage() (certmagic.Storage, error) {
+	if cs.storage == nil {
+		return nil, fmt.Errorf("s3 storage: module not provisioned")
+	}
+	return cs.storage, nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens, e.g.:
+//
+//	storage s3 {
+//	    endpoint          s3.amazonaws.com
+//	    bucket            my-bucket
+//	    access_key_id     {env.S3_ACCESS_KEY_ID}
+//	    secret_access_key {env.S3_SECRET_ACCESS_KEY}
+//	    obj_prefix        caddy-certs
+//	}
+func (cs *CaddyStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			opt := d.Val()
+			switch opt {
+			case "endpoint":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.Endpoint = d.Val()
+			case "bucket":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.Bucket = d.Val()
+			case "access_key_id":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.AccessKeyID = d.Val()
+			case "secret_access_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.SecretAccessKey = d.Val()
+			case "obj_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.ObjPrefix = d.Val()
+			case "insecure":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				b, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("parsing insecure: %v", err)
+				}
+				cs.Insecure = b
+			case "encryption_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.EncryptionKey = d.Val()
+			case "server_side_encryption":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.ServerSideEncryption = d.Val()
+			case "sse_kms_key_id":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.SSEKMSKeyID = d.Val()
+			case "sse_c_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.SSECKey = d.Val()
+			case "credential_provider":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.CredentialProvider = CredentialProvider(d.Val())
+			case "iam_endpoint":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cs.IAMEndpoint = d.Val()
+			case "sts_assume_role":
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch subOpt := d.Val(); subOpt {
+					case "sts_endpoint":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.STSAssumeRole.STSEndpoint = d.Val()
+					case "role_arn":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.STSAssumeRole.RoleARN = d.Val()
+					case "role_session_name":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.STSAssumeRole.RoleSessionName = d.Val()
+					case "duration_seconds":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						n, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("parsing duration_seconds: %v", err)
+						}
+						cs.STSAssumeRole.DurationSeconds = n
+					default:
+						return d.Errf("unrecognized sts_assume_role option '%s'", subOpt)
+					}
+				}
+			case "credentials_file":
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch subOpt := d.Val(); subOpt {
+					case "filename":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.CredentialsFile.Filename = d.Val()
+					case "alias":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.CredentialsFile.Alias = d.Val()
+					default:
+						return d.Errf("unrecognized credentials_file option '%s'", subOpt)
+					}
+				}
+			case "credential_chain":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				providers := make([]CredentialProvider, 0, len(args))
+				for _, a := range args {
+					providers = append(providers, CredentialProvider(a))
+				}
+				cs.CredentialChainProviders = providers
+			case "web_identity":
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch subOpt := d.Val(); subOpt {
+					case "sts_endpoint":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.WebIdentity.STSEndpoint = d.Val()
+					case "role_arn":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.WebIdentity.RoleARN = d.Val()
+					case "token_file":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						cs.WebIdentity.TokenFile = d.Val()
+					case "duration_seconds":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						n, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("parsing duration_seconds: %v", err)
+						}
+						cs.WebIdentity.DurationSeconds = n
+					default:
+						return d.Errf("unrecognized web_identity option '%s'", subOpt)
+					}
+				}
+			case "disable_atomic_lock":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				b, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("parsing disable_atomic_lock: %v", err)
+				}
+				cs.DisableAtomicLock = b
+			case "manage_lifecycle":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				b, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("parsing manage_lifecycle: %v", err)
+				}
+				cs.ManageLifecycle = b
+			case "lock_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := time.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing lock_ttl: %v", err)
+				}
+				cs.LockTTL = dur
+			default:
+				return d.Errf("unrecognized s3 storage option '%s'", opt)
+			}
+		}
+	}
+	return nil
+}
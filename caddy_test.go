@@ -0,0 +1,144 @@
+package cmgs3
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCaddyStorageServerSideEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		cs      CaddyStorage
+		wantErr bool
+		wantNil bool
+	}{
+		{
+			name:    "disabled",
+			cs:      CaddyStorage{},
+			wantNil: true,
+		},
+		{
+			name: "sse-s3",
+			cs:   CaddyStorage{ServerSideEncryption: "s3"},
+		},
+		{
+			name: "sse-kms",
+			cs:   CaddyStorage{ServerSideEncryption: "kms", SSEKMSKeyID: "arn:aws:kms:us-east-1:1:key/abc"},
+		},
+		{
+			name: "sse-c",
+			cs:   CaddyStorage{ServerSideEncryption: "c", SSECKey: "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="},
+		},
+		{
+			name:    "sse-c invalid base64",
+			cs:      CaddyStorage{ServerSideEncryption: "c", SSECKey: "not-base64!!"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			cs:      CaddyStorage{ServerSideEncryption: "bogus"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sse, err := tt.cs.serverSideEncryption()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantNil && sse != nil {
+				t.Fatalf("expected nil ServerSide, got %v", sse)
+			}
+			if !tt.wantNil && sse == nil {
+				t.Fatal("expected a non-nil ServerSide")
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileCredentialSubBlocks(t *testing.T) {
+	cs, err := parseCaddyfile(t, `s3 {
+		endpoint s3.amazonaws.com
+		bucket my-bucket
+		credential_provider sts-assume-role
+		sts_assume_role {
+			sts_endpoint     https://sts.amazonaws.com
+			role_arn         arn:aws:iam::1:role/x
+			role_session_name certmagic
+			duration_seconds 1800
+		}
+		credentials_file {
+			filename /home/user/.mc/config.json
+			alias    default
+		}
+		credential_chain static env iam
+		web_identity {
+			sts_endpoint     https://sts.amazonaws.com
+			role_arn         arn:aws:iam::1:role/y
+			token_file       /var/run/secrets/token
+			duration_seconds 3600
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("unmarshaling caddyfile: %v", err)
+	}
+
+	if got, want := cs.STSAssumeRole.STSEndpoint, "https://sts.amazonaws.com"; got != want {
+		t.Errorf("STSEndpoint = %q, want %q", got, want)
+	}
+	if got, want := cs.STSAssumeRole.RoleARN, "arn:aws:iam::1:role/x"; got != want {
+		t.Errorf("RoleARN = %q, want %q", got, want)
+	}
+	if got, want := cs.STSAssumeRole.RoleSessionName, "certmagic"; got != want {
+		t.Errorf("RoleSessionName = %q, want %q", got, want)
+	}
+	if got, want := cs.STSAssumeRole.DurationSeconds, 1800; got != want {
+		t.Errorf("DurationSeconds = %d, want %d", got, want)
+	}
+
+	if got, want := cs.CredentialsFile.Filename, "/home/user/.mc/config.json"; got != want {
+		t.Errorf("Filename = %q, want %q", got, want)
+	}
+	if got, want := cs.CredentialsFile.Alias, "default"; got != want {
+		t.Errorf("Alias = %q, want %q", got, want)
+	}
+
+	wantChain := []CredentialProvider{CredentialProviderStatic, CredentialProviderEnv, CredentialProviderIAM}
+	if len(cs.CredentialChainProviders) != len(wantChain) {
+		t.Fatalf("CredentialChainProviders = %v, want %v", cs.CredentialChainProviders, wantChain)
+	}
+	for i, p := range wantChain {
+		if cs.CredentialChainProviders[i] != p {
+			t.Errorf("CredentialChainProviders[%d] = %q, want %q", i, cs.CredentialChainProviders[i], p)
+		}
+	}
+
+	if got, want := cs.WebIdentity.STSEndpoint, "https://sts.amazonaws.com"; got != want {
+		t.Errorf("WebIdentity.STSEndpoint = %q, want %q", got, want)
+	}
+	if got, want := cs.WebIdentity.RoleARN, "arn:aws:iam::1:role/y"; got != want {
+		t.Errorf("WebIdentity.RoleARN = %q, want %q", got, want)
+	}
+	if got, want := cs.WebIdentity.TokenFile, "/var/run/secrets/token"; got != want {
+		t.Errorf("WebIdentity.TokenFile = %q, want %q", got, want)
+	}
+	if got, want := cs.WebIdentity.DurationSeconds, 3600; got != want {
+		t.Errorf("WebIdentity.DurationSeconds = %d, want %d", got, want)
+	}
+}
+
+func parseCaddyfile(t *testing.T, input string) (*CaddyStorage, error) {
+	t.Helper()
+	d := caddyfile.NewTestDispenser(input)
+	cs := &CaddyStorage{}
+	err := cs.UnmarshalCaddyfile(d)
+	return cs, err
+}
@@ -3,17 +3,23 @@ package cmgs3
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/certmagic"
 	minio "github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
 )
 
 var _ certmagic.Storage = &S3Storage{}
@@ -29,6 +35,136 @@ type S3Opts struct {
 
 	// EncryptionKey is optional. If you do not wish to encrypt your certficates and key inside the S3 bucket, leave it empty.
 	EncryptionKey []byte
+
+	// ServerSideEncryption is optional. When set, it is passed through to S3
+	// on every put/get/stat so the bucket's objects are encrypted by S3
+	// itself (SSE-C, SSE-KMS or SSE-S3, via encrypt.NewSSEC/NewSSEKMS/NewSSE)
+	// and stay readable by AWS tooling such as lifecycle, replication and
+	// access scans. It can be combined with EncryptionKey to additionally
+	// encrypt the plaintext client-side before it ever reaches S3.
+	ServerSideEncryption encrypt.ServerSide
+
+	// DisableAtomicLock falls back to the old read-then-write locking
+	// behavior (racy, but backend-agnostic) for S3-compatible gateways
+	// that don't honor conditional PUT (If-None-Match/If-Match). Leave
+	// this false unless Lock starts failing with unexpected errors.
+	DisableAtomicLock bool
+
+	// Credentials, if set, is used as-is and takes priority over
+	// AccessKeyID/SecretAccessKey and CredentialProvider below. Use this to
+	// hand in a provider this package has no dedicated option for.
+	Credentials *credentials.Credentials
+
+	// CredentialProvider selects how to obtain S3 credentials when
+	// Credentials is nil. Defaults to CredentialProviderStatic, which uses
+	// AccessKeyID/SecretAccessKey as before.
+	CredentialProvider CredentialProvider
+
+	// IAMEndpoint overrides the EC2/ECS/EKS instance metadata endpoint used
+	// by CredentialProviderIAM. Leave empty to let minio-go auto-detect it.
+	IAMEndpoint string
+
+	// STSAssumeRole configures CredentialProviderSTSAssumeRole.
+	STSAssumeRole STSAssumeRoleOpts
+
+	// CredentialsFile configures CredentialProviderFileMinio.
+	CredentialsFile CredentialsFileOpts
+
+	// WebIdentity configures CredentialProviderWebIdentity.
+	WebIdentity WebIdentityOpts
+
+	// CredentialChainProviders configures, in priority order, the providers
+	// to try when CredentialProvider is CredentialProviderChain. Only
+	// CredentialProviderStatic, CredentialProviderEnv,
+	// CredentialProviderIAM and CredentialProviderFileMinio are valid chain
+	// members.
+	CredentialChainProviders []CredentialProvider
+
+	// ManageLifecycle, if true, makes NewS3Storage install (or update) a
+	// bucket lifecycle rule that expires `.lock` objects older than LockTTL,
+	// so lock files left behind by crashed instances don't accumulate
+	// forever. The rule is scoped to lock objects only, via a tag applied
+	// when they're written, and is reconciled by rule ID on every start so
+	// it won't fight other lifecycle tooling managing unrelated rules.
+	ManageLifecycle bool
+
+	// LockTTL is the age after which a `.lock` object becomes eligible for
+	// automatic expiration when ManageLifecycle is set. S3 lifecycle rules
+	// only support day granularity, so this is rounded up to the next full
+	// day (minimum one). Defaults to 1 day if zero.
+	LockTTL time.Duration
+}
+
+// CredentialProvider selects the minio-go credential provider NewS3Storage
+// constructs when S3Opts.Credentials is not set directly.
+type CredentialProvider string
+
+const (
+	// CredentialProviderStatic uses AccessKeyID/SecretAccessKey. This is the
+	// default.
+	CredentialProviderStatic CredentialProvider = "static"
+	// CredentialProviderEnv reads AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY
+	// (or their MinIO equivalents) from the environment.
+	CredentialProviderEnv CredentialProvider = "env"
+	// CredentialProviderIAM uses the EC2/ECS/EKS instance or pod identity
+	// metadata service. Its Retrieve() also auto-detects
+	// AWS_WEB_IDENTITY_TOKEN_FILE, so pure env-var-driven IRSA/EKS pod
+	// identity mostly works through this provider already;
+	// CredentialProviderWebIdentity below is for when RoleARN or the token
+	// path need to be set explicitly instead of via environment variables.
+	CredentialProviderIAM CredentialProvider = "iam"
+	// CredentialProviderWebIdentity exchanges an OIDC token (e.g. an
+	// EKS/IRSA pod identity token) for temporary credentials via STS
+	// AssumeRoleWithWebIdentity, per WebIdentity.
+	CredentialProviderWebIdentity CredentialProvider = "web-identity"
+	// CredentialProviderSTSAssumeRole exchanges AccessKeyID/SecretAccessKey
+	// for temporary credentials via STS AssumeRole, per STSAssumeRole.
+	CredentialProviderSTSAssumeRole CredentialProvider = "sts-assume-role"
+	// CredentialProviderFileMinio reads from an mc-style
+	// ~/.mc/config.json-formatted credentials file, per CredentialsFile.
+	CredentialProviderFileMinio CredentialProvider = "file-minio"
+	// CredentialProviderChain tries CredentialChainProviders in order and
+	// uses the first one that returns a non-anonymous value.
+	CredentialProviderChain CredentialProvider = "chain"
+)
+
+// STSAssumeRoleOpts configures the sts-assume-role credential provider.
+//
+// minio-go's STSAssumeRoleOptions has no field for AWS STS's ExternalId, so
+// it cannot be set through this package yet.
+type STSAssumeRoleOpts struct {
+	STSEndpoint     string
+	RoleARN         string
+	RoleSessionName string
+	DurationSeconds int
+}
+
+// WebIdentityOpts configures the web-identity credential provider.
+//
+// minio-go's STSWebIdentity has no exported field for the role session name,
+// so it cannot be set through this package and is generated per-request
+// instead.
+type WebIdentityOpts struct {
+	STSEndpoint string
+	RoleARN     string
+	// TokenFile is the path to the OIDC token file, typically the path EKS
+	// mounts via AWS_WEB_IDENTITY_TOKEN_FILE. If empty, that environment
+	// variable is used.
+	TokenFile string
+	// DurationSeconds is the requested credential lifetime, passed through
+	// to STS. Leave zero to use STS's default.
+	DurationSeconds int
+}
+
+// CredentialsFileOpts configures the file-minio credential provider.
+type CredentialsFileOpts struct {
+	// Filename is the path to the mc config.json-style credentials file. If
+	// empty, minio-go falls back to $MINIO_SHARED_CREDENTIALS_FILE or the
+	// current user's "$HOME/.mc/config.json".
+	Filename string
+	// Alias selects which entry of the file to use. If empty, minio-go
+	// falls back to $MINIO_ALIAS or "default".
+	Alias string
 }
 
 type S3Storage struct {
@@ -37,12 +173,19 @@ type S3Storage struct {
 	s3client *minio.Client
 
 	iowrap IO
+	sse    encrypt.ServerSide
+
+	instanceID        string
+	disableAtomicLock bool
 }
 
 func NewS3Storage(ctx context.Context, opts S3Opts) (*S3Storage, error) {
 	gs3 := &S3Storage{
-		prefix: opts.ObjPrefix,
-		bucket: opts.Bucket,
+		prefix:            opts.ObjPrefix,
+		bucket:            opts.Bucket,
+		sse:               opts.ServerSideEncryption,
+		instanceID:        newInstanceID(),
+		disableAtomicLock: opts.DisableAtomicLock,
 	}
 
 	if opts.EncryptionKey == nil || len(opts.EncryptionKey) == 0 {
@@ -57,18 +200,28 @@ func NewS3Storage(ctx context.Context, opts S3Opts) (*S3Storage, error) {
 		gs3.iowrap = sb
 	}
 
-	var err error
+	baseTransport, err := minio.DefaultTransport(!opts.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("building s3 transport: %w", err)
+	}
+
+	creds, err := newCredentials(opts)
+	if err != nil {
+		return nil, fmt.Errorf("configuring s3 credentials: %w", err)
+	}
+
 	gs3.s3client, err = minio.New(opts.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(opts.AccessKeyID, opts.SecretAccessKey, ""),
-		Secure: !opts.Insecure,
+		Creds:     creds,
+		Secure:    !opts.Insecure,
+		Transport: &conditionalWriteTransport{base: baseTransport},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("geting s3 client: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	bucketCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	ok, err := gs3.s3client.BucketExists(ctx, opts.Bucket)
+	ok, err := gs3.s3client.BucketExists(bucketCtx, opts.Bucket)
 	if err != nil {
 		return nil, fmt.Errorf("checking if bucket exists: %w", err)
 	}
@@ -76,56 +229,353 @@ func NewS3Storage(ctx context.Context, opts S3Opts) (*S3Storage, error) {
 		return nil, fmt.Errorf("S3 bucket %s does not exist", opts.Bucket)
 	}
 
+	if opts.ManageLifecycle {
+		// Its own timeout: unlike the single BucketExists call above, this
+		// is a read-then-maybe-write (GetBucketLifecycle, optionally
+		// SetBucketLifecycle), so it shouldn't share - and shrink - the
+		// budget meant for that one call.
+		lifecycleCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := gs3.ensureLockLifecycle(lifecycleCtx, opts.LockTTL); err != nil {
+			return nil, fmt.Errorf("configuring lock lifecycle policy: %w", err)
+		}
+	}
+
 	return gs3, nil
 }
 
+const (
+	lockLifecycleRuleID = "certmagic-lock-expiry"
+	lockTagKey          = "certmagic-lock"
+	lockTagValue        = "true"
+)
+
+// ensureLockLifecycle installs or updates a bucket lifecycle rule that
+// expires tagged `.lock` objects after ttl. It reads the existing
+// configuration, diffs the desired rule against it by rule ID, and only
+// writes back when the rule is missing or has drifted, so it doesn't fight
+// other lifecycle tooling managing unrelated rules.
+func (gs *S3Storage) ensureLockLifecycle(ctx context.Context, ttl time.Duration) error {
+	desired := lifecycle.Rule{
+		ID:     lockLifecycleRuleID,
+		Status: "Enabled",
+		RuleFilter: lifecycle.Filter{
+			Tag: lifecycle.Tag{Key: lockTagKey, Value: lockTagValue},
+		},
+		Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(lockTTLDays(ttl))},
+	}
+
+	cfg, err := gs.s3client.GetBucketLifecycle(ctx, gs.bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return fmt.Errorf("reading bucket lifecycle: %w", err)
+		}
+		cfg = lifecycle.NewConfiguration()
+	}
+
+	rules := make([]lifecycle.Rule, 0, len(cfg.Rules)+1)
+	for _, r := range cfg.Rules {
+		if r.ID == desired.ID {
+			if lifecycleRuleUpToDate(r, desired) {
+				return nil // already up to date
+			}
+			continue // drifted; replaced below
+		}
+		rules = append(rules, r)
+	}
+	cfg.Rules = append(rules, desired)
+
+	if err := gs.s3client.SetBucketLifecycle(ctx, gs.bucket, cfg); err != nil {
+		return fmt.Errorf("writing bucket lifecycle: %w", err)
+	}
+	return nil
+}
+
+// lifecycleRuleUpToDate reports whether r already matches desired. Tag fields
+// are compared individually rather than via RuleFilter.Tag == RuleFilter.Tag:
+// lifecycle.Tag embeds XMLName, which a rule round-tripped through
+// GetBucketLifecycle's XML unmarshal populates but a freshly-built literal
+// like desired leaves zero, so a struct-level comparison would never be true
+// even when Key/Value match.
+func lifecycleRuleUpToDate(r, desired lifecycle.Rule) bool {
+	return r.Status == desired.Status &&
+		r.Expiration.Days == desired.Expiration.Days &&
+		r.RuleFilter.Tag.Key == desired.RuleFilter.Tag.Key &&
+		r.RuleFilter.Tag.Value == desired.RuleFilter.Tag.Value
+}
+
+// lockTTLDays rounds ttl up to S3's 1-day lifecycle expiration granularity.
+func lockTTLDays(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 1
+	}
+	days := int(math.Ceil(ttl.Hours() / 24))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// newCredentials builds the minio-go credentials provider for opts. If
+// opts.Credentials is set it is used as-is; otherwise opts.CredentialProvider
+// selects which provider to construct.
+func newCredentials(opts S3Opts) (*credentials.Credentials, error) {
+	if opts.Credentials != nil {
+		return opts.Credentials, nil
+	}
+
+	switch opts.CredentialProvider {
+	case "", CredentialProviderStatic:
+		return credentials.NewStaticV4(opts.AccessKeyID, opts.SecretAccessKey, ""), nil
+	case CredentialProviderEnv:
+		return credentials.NewEnvAWS(), nil
+	case CredentialProviderIAM:
+		return credentials.NewIAM(opts.IAMEndpoint), nil
+	case CredentialProviderSTSAssumeRole:
+		return credentials.NewSTSAssumeRole(opts.STSAssumeRole.STSEndpoint, credentials.STSAssumeRoleOptions{
+			AccessKey:       opts.AccessKeyID,
+			SecretKey:       opts.SecretAccessKey,
+			RoleARN:         opts.STSAssumeRole.RoleARN,
+			RoleSessionName: opts.STSAssumeRole.RoleSessionName,
+			DurationSeconds: opts.STSAssumeRole.DurationSeconds,
+		})
+	case CredentialProviderFileMinio:
+		return credentials.NewFileMinioClient(opts.CredentialsFile.Filename, opts.CredentialsFile.Alias), nil
+	case CredentialProviderWebIdentity:
+		return newWebIdentityCredentials(opts.WebIdentity)
+	case CredentialProviderChain:
+		providers := make([]credentials.Provider, 0, len(opts.CredentialChainProviders))
+		for _, p := range opts.CredentialChainProviders {
+			provider, err := credentialChainMember(p, opts)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		}
+		return credentials.NewChainCredentials(providers), nil
+	default:
+		return nil, fmt.Errorf("unknown credential provider %q", opts.CredentialProvider)
+	}
+}
+
+// newWebIdentityCredentials builds the web-identity (IRSA) provider from
+// opts, reading the OIDC token from TokenFile (or AWS_WEB_IDENTITY_TOKEN_FILE
+// if that's unset) on every Retrieve, since STS requires a fresh token each
+// time.
+func newWebIdentityCredentials(opts WebIdentityOpts) (*credentials.Credentials, error) {
+	tokenFile := opts.TokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if tokenFile == "" {
+		return nil, errors.New("web-identity credential provider requires TokenFile or AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if opts.STSEndpoint == "" {
+		return nil, errors.New("web-identity credential provider requires STSEndpoint")
+	}
+
+	return credentials.New(&credentials.STSWebIdentity{
+		Client:      http.DefaultClient,
+		STSEndpoint: opts.STSEndpoint,
+		RoleARN:     opts.RoleARN,
+		GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+			token, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading web identity token: %w", err)
+			}
+			return &credentials.WebIdentityToken{Token: string(token), Expiry: opts.DurationSeconds}, nil
+		},
+	}), nil
+}
+
+// credentialChainMember builds the raw credentials.Provider backing a single
+// CredentialProviderChain entry.
+func credentialChainMember(p CredentialProvider, opts S3Opts) (credentials.Provider, error) {
+	switch p {
+	case CredentialProviderStatic:
+		return &credentials.Static{Value: credentials.Value{
+			AccessKeyID:     opts.AccessKeyID,
+			SecretAccessKey: opts.SecretAccessKey,
+			SignerType:      credentials.SignatureV4,
+		}}, nil
+	case CredentialProviderEnv:
+		return &credentials.EnvAWS{}, nil
+	case CredentialProviderIAM:
+		return &credentials.IAM{Client: http.DefaultClient, Endpoint: opts.IAMEndpoint}, nil
+	case CredentialProviderFileMinio:
+		return &credentials.FileMinioClient{Filename: opts.CredentialsFile.Filename, Alias: opts.CredentialsFile.Alias}, nil
+	default:
+		return nil, fmt.Errorf("credential provider %q cannot be used as a chain member", p)
+	}
+}
+
 var (
 	LockExpiration   = 2 * time.Minute
 	LockPollInterval = 1 * time.Second
 	LockTimeout      = 15 * time.Second
 )
 
+// lockInfo is the JSON body stored in a `.lock` object. Holder and Expires
+// let a competing instance tell a live lock from an abandoned one without
+// guessing from object metadata.
+type lockInfo struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+type lockConditionKey struct{}
+
+// lockCondition carries the conditional-write headers a PUT should be sent
+// with. minio-go's PutObjectOptions has no If-Match/If-None-Match support,
+// so conditionalWriteTransport pulls this out of the request context and
+// sets the headers on the wire instead.
+type lockCondition struct {
+	// IfNoneMatch requests "If-None-Match: *", i.e. "only create if the
+	// object doesn't exist yet".
+	IfNoneMatch bool
+	// IfMatch requests "If-Match: <etag>", i.e. "only overwrite if the
+	// object still has this exact ETag".
+	IfMatch string
+}
+
+func withLockCondition(ctx context.Context, c lockCondition) context.Context {
+	return context.WithValue(ctx, lockConditionKey{}, c)
+}
+
+// conditionalWriteTransport injects If-Match/If-None-Match headers on
+// outgoing requests carrying a lockCondition in their context, turning a
+// plain PutObject into an atomic compare-and-swap against S3/MinIO.
+type conditionalWriteTransport struct {
+	base http.RoundTripper
+}
+
+func (t *conditionalWriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c, ok := req.Context().Value(lockConditionKey{}).(lockCondition); ok {
+		if c.IfNoneMatch {
+			req.Header.Set("If-None-Match", "*")
+		}
+		if c.IfMatch != "" {
+			req.Header.Set("If-Match", `"`+c.IfMatch+`"`)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
 func (gs *S3Storage) Lock(ctx context.Context, key string) error {
+	if gs.disableAtomicLock {
+		return gs.lockBestEffort(ctx, key)
+	}
+	return gs.lockAtomic(ctx, key)
+}
+
+// lockAtomic acquires the lock with a conditional PUT (If-None-Match: *), so
+// two instances racing on a missing lock file can't both believe they won.
+// Stealing a stale lock is itself a conditional PUT gated on the ETag we
+// last observed (If-Match), so two stealers can't both win either.
+func (gs *S3Storage) lockAtomic(ctx context.Context, key string) error {
 	var respErr minio.ErrorResponse
 	startedAt := time.Now()
 	lockFile := gs.objLockName(key)
 
 	for {
-		obj, err := gs.s3client.GetObject(ctx, gs.bucket, lockFile, minio.GetObjectOptions{})
-		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
-			return gs.putLockFile(ctx, key)
+		if time.Since(startedAt) > LockTimeout {
+			return fmt.Errorf("acquiring lock for %q timed out after %s", key, LockTimeout)
 		}
 
-		if err != nil {
+		createCtx := withLockCondition(ctx, lockCondition{IfNoneMatch: true})
+		if err := gs.putLockFile(createCtx, lockFile, minio.PutObjectOptions{}); err == nil {
+			return nil
+		} else if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusPreconditionFailed {
 			return fmt.Errorf("acquiring lock failed: %w", err)
 		}
 
-		buf, err := ioutil.ReadAll(obj)
+		// Someone else holds the lock file; see if it's stale enough to steal.
+		oi, err := gs.s3client.StatObject(ctx, gs.bucket, lockFile, minio.StatObjectOptions{ServerSideEncryption: gs.sse})
 		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
-			return gs.putLockFile(ctx, key)
+			continue // raced with an Unlock; retry the conditional create
+		}
+		if err != nil {
+			return fmt.Errorf("checking existing lock: %w", err)
 		}
 
+		li, err := gs.readLockInfo(ctx, lockFile)
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			continue // raced with an Unlock; retry the conditional create
+		}
 		if err != nil {
-			// Retry
-			return fmt.Errorf("reading lock file: %w", err)
+			// A transient read failure (network blip, timeout, partial
+			// read) is not proof the lock is stale - only a 404 or a
+			// successfully parsed, actually-expired lockInfo license a
+			// steal. Back off and retry instead.
+			select {
+			case <-time.After(LockPollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if time.Now().After(li.Expires) {
+			stealCtx := withLockCondition(ctx, lockCondition{IfMatch: oi.ETag})
+			err = gs.putLockFile(stealCtx, lockFile, minio.PutObjectOptions{})
+			if err == nil {
+				log.Printf("[INFO][S3Storage] stole stale lock for %q: %s", key, lockFile)
+				return nil
+			}
+			if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+				continue // another instance stole it first; retry from the top
+			}
+			return fmt.Errorf("stealing stale lock: %w", err)
+		}
+
+		// lockfile exists and is not stale;
+		// just wait a moment and try again,
+		// or return if context cancelled
+		select {
+		case <-time.After(LockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// lockBestEffort is the pre-conditional-write locking behavior: a plain GET
+// followed by a PUT, kept around for S3-compatible gateways that reject
+// conditional writes. It is racy: two instances can both observe a missing
+// lock file and both believe they acquired it.
+func (gs *S3Storage) lockBestEffort(ctx context.Context, key string) error {
+	var respErr minio.ErrorResponse
+	startedAt := time.Now()
+	lockFile := gs.objLockName(key)
+
+	for {
+		li, err := gs.readLockInfo(ctx, lockFile)
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return gs.putLockFile(ctx, lockFile, minio.PutObjectOptions{})
 		}
 
-		lockedAt, err := time.Parse(time.RFC3339, string(buf))
 		if err != nil {
-			// Lock file does not make sense, overwrite.
-			return gs.putLockFile(ctx, key)
+			// Lock file missing or unreadable; overwrite.
+			return gs.putLockFile(ctx, lockFile, minio.PutObjectOptions{})
 		}
 
-		if startedAt.Add(LockTimeout).After(lockedAt) {
+		if startedAt.Add(LockTimeout).After(li.Expires) {
 			// Existing lock file expired, overwrite.
-			return gs.putLockFile(ctx, key)
+			return gs.putLockFile(ctx, lockFile, minio.PutObjectOptions{})
 		}
 
-		// Has been locked for too long. There is a problem
-		if startedAt.Add(LockExpiration).After(lockedAt) {
+		if time.Now().After(li.Expires) {
 			log.Printf(
-				"[INFO][S3Storage] Lock for '%s' is stale (locked at: %s); removing then retrying: %s",
-				key, lockedAt, gs.objLockName(key),
+				"[INFO][S3Storage] Lock for '%s' is stale (holder: %s, expired: %s); removing then retrying: %s",
+				key, li.Holder, li.Expires, lockFile,
 			)
 			err = gs.Delete(ctx, lockFile)
 			if err != nil {
@@ -135,7 +585,7 @@ func (gs *S3Storage) Lock(ctx context.Context, key string) error {
 			}
 
 			// Existing lock file is stale. Replace
-			return gs.putLockFile(ctx, key)
+			return gs.putLockFile(ctx, lockFile, minio.PutObjectOptions{})
 		}
 
 		// lockfile exists and is not stale;
@@ -149,23 +599,74 @@ func (gs *S3Storage) Lock(ctx context.Context, key string) error {
 	}
 }
 
-func (gs *S3Storage) putLockFile(ctx context.Context, key string) error {
-	// Object does not exist, we're creating a lock file.
-	r := bytes.NewReader([]byte(time.Now().Format(time.RFC3339)))
-	_, err := gs.s3client.PutObject(
-		ctx,
-		gs.bucket,
-		gs.objLockName(key),
-		r,
-		int64(r.Len()),
-		minio.PutObjectOptions{},
-	)
+func (gs *S3Storage) readLockInfo(ctx context.Context, lockFile string) (lockInfo, error) {
+	var li lockInfo
+
+	obj, err := gs.s3client.GetObject(ctx, gs.bucket, lockFile, minio.GetObjectOptions{ServerSideEncryption: gs.sse})
+	if err != nil {
+		return li, err
+	}
+	defer obj.Close()
 
+	buf, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return li, fmt.Errorf("reading lock file: %w", err)
+	}
+
+	if err := json.Unmarshal(buf, &li); err != nil {
+		return li, fmt.Errorf("lock file does not make sense: %w", err)
+	}
+	return li, nil
+}
+
+// putLockFile writes a fresh lock object for the current instance, subject
+// to whatever conditional headers opts carries.
+func (gs *S3Storage) putLockFile(ctx context.Context, lockFile string, opts minio.PutObjectOptions) error {
+	buf, err := json.Marshal(lockInfo{
+		Holder:  gs.instanceID,
+		Expires: time.Now().Add(LockExpiration),
+	})
+	if err != nil {
+		return err
+	}
+
+	opts.ServerSideEncryption = gs.sse
+	opts.UserTags = map[string]string{lockTagKey: lockTagValue}
+	_, err = gs.s3client.PutObject(ctx, gs.bucket, lockFile, bytes.NewReader(buf), int64(len(buf)), opts)
 	return err
 }
 
+// Unlock releases the lock this instance holds on key. It only deletes the
+// lock object if this instance is still its recorded holder, gated by a
+// conditional delete on the ETag it last observed: without this, an instance
+// that stalled past LockExpiration and had its lock legitimately stolen by
+// another instance (see lockAtomic) would blindly delete that instance's
+// live lock on finally calling Unlock.
 func (gs *S3Storage) Unlock(ctx context.Context, key string) error {
-	return gs.s3client.RemoveObject(ctx, gs.bucket, gs.objLockName(key), minio.RemoveObjectOptions{})
+	var respErr minio.ErrorResponse
+	lockFile := gs.objLockName(key)
+
+	oi, err := gs.s3client.StatObject(ctx, gs.bucket, lockFile, minio.StatObjectOptions{ServerSideEncryption: gs.sse})
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		return nil // already gone
+	}
+	if err != nil {
+		return fmt.Errorf("checking lock before unlock: %w", err)
+	}
+
+	li, err := gs.readLockInfo(ctx, lockFile)
+	if err != nil || li.Holder != gs.instanceID {
+		// Not ours (anymore); leave it alone instead of deleting a live
+		// lock out from under whoever holds it now.
+		return nil
+	}
+
+	deleteCtx := withLockCondition(ctx, lockCondition{IfMatch: oi.ETag})
+	err = gs.s3client.RemoveObject(deleteCtx, gs.bucket, lockFile, minio.RemoveObjectOptions{})
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+		return nil // raced with a steal between our check and the delete
+	}
+	return err
 }
 
 func (gs *S3Storage) Store(ctx context.Context, key string, value []byte) error {
@@ -175,14 +676,14 @@ func (gs *S3Storage) Store(ctx context.Context, key string, value []byte) error
 		gs.objName(key),
 		r,
 		int64(r.Len()),
-		minio.PutObjectOptions{},
+		minio.PutObjectOptions{ServerSideEncryption: gs.sse},
 	)
 
 	return err
 }
 
 func (gs *S3Storage) Load(ctx context.Context, key string) ([]byte, error) {
-	r, err := gs.s3client.GetObject(ctx, gs.bucket, gs.objName(key), minio.GetObjectOptions{})
+	r, err := gs.s3client.GetObject(ctx, gs.bucket, gs.objName(key), minio.GetObjectOptions{ServerSideEncryption: gs.sse})
 	if err != nil {
 		var respErr minio.ErrorResponse
 		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
@@ -210,24 +711,71 @@ func (gs *S3Storage) Delete(ctx context.Context, key string) error {
 }
 
 func (gs *S3Storage) Exists(ctx context.Context, key string) bool {
-	_, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), minio.StatObjectOptions{})
+	_, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), minio.StatObjectOptions{ServerSideEncryption: gs.sse})
 	return err == nil
 }
 
 func (gs *S3Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	out := make(chan certmagic.KeyInfo)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- gs.list(ctx, prefix, recursive, out)
+	}()
+
 	var keys []string
+	for ki := range out {
+		keys = append(keys, ki.Key)
+	}
+	return keys, <-errc
+}
+
+// ListIter is a streaming variant of List for callers that don't want to
+// buffer the whole result in memory. Unlike List, a failed listing is logged
+// and simply stops the stream rather than being returned to the caller.
+func (gs *S3Storage) ListIter(ctx context.Context, prefix string, recursive bool) <-chan certmagic.KeyInfo {
+	out := make(chan certmagic.KeyInfo)
+	go func() {
+		if err := gs.list(ctx, prefix, recursive, out); err != nil {
+			log.Printf("[ERROR][S3Storage] listing %q: %s", prefix, err)
+		}
+	}()
+	return out
+}
+
+// list streams CertMagic-relative keys under prefix to out, closing it when
+// done. Non-recursive listings collapse on "/", surfaced by S3 as
+// pseudo-directory common-prefix entries.
+func (gs *S3Storage) list(ctx context.Context, prefix string, recursive bool, out chan<- certmagic.KeyInfo) error {
+	defer close(out)
+
 	for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
-		Prefix:    gs.objName(""),
-		Recursive: true,
+		Prefix:    gs.objName(prefix),
+		Recursive: recursive,
 	}) {
-		keys = append(keys, obj.Key)
+		if obj.Err != nil {
+			return obj.Err
+		}
+
+		ki := certmagic.KeyInfo{
+			Key:        strings.TrimPrefix(obj.Key, gs.prefix+"/"),
+			Size:       obj.Size,
+			Modified:   obj.LastModified,
+			IsTerminal: !strings.HasSuffix(obj.Key, "/"),
+		}
+
+		select {
+		case out <- ki:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return keys, nil
+
+	return nil
 }
 
 func (gs *S3Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
 	var ki certmagic.KeyInfo
-	oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), minio.StatObjectOptions{})
+	oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), minio.StatObjectOptions{ServerSideEncryption: gs.sse})
 	if err != nil {
 		var respErr minio.ErrorResponse
 		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
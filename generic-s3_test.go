@@ -0,0 +1,147 @@
+package cmgs3
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+func TestNewCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    S3Opts
+		wantErr bool
+	}{
+		{
+			name: "static default",
+			opts: S3Opts{AccessKeyID: "id", SecretAccessKey: "secret"},
+		},
+		{
+			name: "static explicit",
+			opts: S3Opts{CredentialProvider: CredentialProviderStatic, AccessKeyID: "id", SecretAccessKey: "secret"},
+		},
+		{
+			name: "env",
+			opts: S3Opts{CredentialProvider: CredentialProviderEnv},
+		},
+		{
+			name: "iam",
+			opts: S3Opts{CredentialProvider: CredentialProviderIAM},
+		},
+		{
+			name: "sts-assume-role",
+			opts: S3Opts{
+				CredentialProvider: CredentialProviderSTSAssumeRole,
+				AccessKeyID:        "id",
+				SecretAccessKey:    "secret",
+				STSAssumeRole:      STSAssumeRoleOpts{STSEndpoint: "https://sts.amazonaws.com", RoleARN: "arn:aws:iam::1:role/x"},
+			},
+		},
+		{
+			name:    "sts-assume-role missing endpoint",
+			opts:    S3Opts{CredentialProvider: CredentialProviderSTSAssumeRole, AccessKeyID: "id", SecretAccessKey: "secret"},
+			wantErr: true,
+		},
+		{
+			name: "file-minio",
+			opts: S3Opts{CredentialProvider: CredentialProviderFileMinio},
+		},
+		{
+			name: "web-identity",
+			opts: S3Opts{
+				CredentialProvider: CredentialProviderWebIdentity,
+				WebIdentity:        WebIdentityOpts{STSEndpoint: "https://sts.amazonaws.com", TokenFile: "/var/run/secrets/token"},
+			},
+		},
+		{
+			name:    "web-identity missing token file",
+			opts:    S3Opts{CredentialProvider: CredentialProviderWebIdentity, WebIdentity: WebIdentityOpts{STSEndpoint: "https://sts.amazonaws.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "web-identity missing endpoint",
+			opts:    S3Opts{CredentialProvider: CredentialProviderWebIdentity, WebIdentity: WebIdentityOpts{TokenFile: "/var/run/secrets/token"}},
+			wantErr: true,
+		},
+		{
+			name: "chain",
+			opts: S3Opts{
+				CredentialProvider:       CredentialProviderChain,
+				AccessKeyID:              "id",
+				SecretAccessKey:          "secret",
+				CredentialChainProviders: []CredentialProvider{CredentialProviderStatic, CredentialProviderEnv, CredentialProviderIAM, CredentialProviderFileMinio},
+			},
+		},
+		{
+			name:    "chain with invalid member",
+			opts:    S3Opts{CredentialProvider: CredentialProviderChain, CredentialChainProviders: []CredentialProvider{CredentialProviderSTSAssumeRole}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown provider",
+			opts:    S3Opts{CredentialProvider: "bogus"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := newCredentials(tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if creds == nil {
+				t.Fatal("expected non-nil credentials")
+			}
+		})
+	}
+}
+
+func TestNewCredentialsExplicitOverride(t *testing.T) {
+	override := credentials.NewStaticV4("override-id", "override-secret", "")
+	creds, err := newCredentials(S3Opts{Credentials: override, AccessKeyID: "ignored"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds != override {
+		t.Fatal("expected the explicit Credentials to be returned as-is, taking priority over AccessKeyID")
+	}
+}
+
+func TestLifecycleRuleUpToDate(t *testing.T) {
+	desired := lifecycle.Rule{
+		ID:         lockLifecycleRuleID,
+		Status:     "Enabled",
+		RuleFilter: lifecycle.Filter{Tag: lifecycle.Tag{Key: lockTagKey, Value: lockTagValue}},
+		Expiration: lifecycle.Expiration{Days: 1},
+	}
+
+	// A rule round-tripped through GetBucketLifecycle's XML unmarshal
+	// populates Tag.XMLName; a freshly-built rule like desired does not.
+	// The comparison must still consider them equal.
+	roundTripped := desired
+	roundTripped.RuleFilter.Tag.XMLName.Local = "Tag"
+
+	if !lifecycleRuleUpToDate(roundTripped, desired) {
+		t.Fatal("expected a rule differing only in Tag.XMLName to be considered up to date")
+	}
+
+	drifted := desired
+	drifted.Expiration.Days = 7
+	if lifecycleRuleUpToDate(drifted, desired) {
+		t.Fatal("expected a rule with a different expiration to be considered drifted")
+	}
+
+	drifted = desired
+	drifted.RuleFilter.Tag.Value = "false"
+	if lifecycleRuleUpToDate(drifted, desired) {
+		t.Fatal("expected a rule with a different tag value to be considered drifted")
+	}
+}
@@ -0,0 +1,125 @@
+//go:build integration
+
+// This file exercises the module end to end against a real MinIO container:
+// Caddyfile -> CaddyStorage.Provision -> S3Storage -> real bucket
+// operations, covering the same calls certmagic makes while issuing a
+// certificate (Lock, Store, Load, Exists, List, Unlock). Driving an actual
+// ACME handshake against a CA is out of scope here - that's certmagic's own,
+// already-tested responsibility; this package only owns the storage side.
+//
+// Requires Docker. Not run by a plain `go test ./...` since it's gated
+// behind the integration build tag:
+//
+//	go test -tags=integration ./...
+package cmgs3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	tcminio "github.com/testcontainers/testcontainers-go/modules/minio"
+)
+
+func TestIntegrationCaddyfileToS3Storage(t *testing.T) {
+	ctx := context.Background()
+
+	container, err := tcminio.RunContainer(ctx,
+		tcminio.WithUsername("minioadmin"),
+		tcminio.WithPassword("minioadmin-secret"),
+	)
+	if err != nil {
+		t.Fatalf("starting minio container: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Logf("terminating minio container: %v", err)
+		}
+	})
+
+	endpoint, err := container.ConnectionString(ctx)
+	if err != nil {
+		t.Fatalf("getting minio connection string: %v", err)
+	}
+
+	const bucket = "certmagic-test"
+	admin, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(container.Username, container.Password, ""),
+		Secure: false,
+	})
+	if err != nil {
+		t.Fatalf("creating admin client: %v", err)
+	}
+	if err := admin.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatalf("creating bucket: %v", err)
+	}
+
+	cs := &CaddyStorage{}
+	d := caddyfile.NewTestDispenser(`s3 {
+		endpoint          ` + endpoint + `
+		bucket            ` + bucket + `
+		access_key_id     ` + container.Username + `
+		secret_access_key ` + container.Password + `
+		insecure          true
+		obj_prefix        caddy-certs
+	}`)
+	if err := cs.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshaling caddyfile: %v", err)
+	}
+
+	caddyCtx, cancel := caddy.NewContext(caddy.Context{Context: ctx})
+	defer cancel()
+	if err := cs.Provision(caddyCtx); err != nil {
+		t.Fatalf("provisioning storage: %v", err)
+	}
+
+	storage, err := cs.CertMagicStorage()
+	if err != nil {
+		t.Fatalf("getting certmagic storage: %v", err)
+	}
+
+	const key = "acme/example.com/example.com.crt"
+	const lockKey = "issue_cert_example.com"
+
+	if err := storage.Lock(ctx, lockKey); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	if err := storage.Store(ctx, key, []byte("fake-certificate-bytes")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	if !storage.Exists(ctx, key) {
+		t.Fatal("Exists returned false for a key that was just Stored")
+	}
+
+	got, err := storage.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(got) != "fake-certificate-bytes" {
+		t.Fatalf("Load = %q, want %q", got, "fake-certificate-bytes")
+	}
+
+	keys, err := storage.List(ctx, "acme/example.com", true)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("List = %v, want [%s]", keys, key)
+	}
+
+	if err := storage.Unlock(ctx, lockKey); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if storage.Exists(ctx, key) {
+		t.Fatal("Exists returned true for a key that was just Deleted")
+	}
+}